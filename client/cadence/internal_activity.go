@@ -0,0 +1,99 @@
+package cadence
+
+// All code in this file is private to the package, except the functions
+// that are explicitly part of the public activity API (RecordActivityTaskHeartbeat).
+
+import (
+	"sync"
+	"time"
+
+	m "code.uber.internal/devexp/minions-client-go.git/.gen/go/minions"
+	s "code.uber.internal/devexp/minions-client-go.git/.gen/go/shared"
+	"code.uber.internal/devexp/minions-client-go.git/common"
+	"golang.org/x/net/context"
+)
+
+type (
+	// activityEnvContextKeyType is the unexported type used to store the
+	// activityEnvironment on a context.Context.
+	activityEnvContextKeyType struct{}
+
+	// activityEnvironment carries the state needed to service heartbeats
+	// and cancellation for a single activity execution.
+	activityEnvironment struct {
+		taskToken         []byte
+		identity          string
+		service           m.TChanWorkflowService
+		activityType      ActivityType
+		activityID        string
+		workflowExecution WorkflowExecution
+		cancel            context.CancelFunc
+		heartbeatInterval time.Duration
+		heartbeatMutex    sync.Mutex
+		lastHeartbeatData []byte
+	}
+)
+
+// activityEnvContextKey is the context.Context key under which the current
+// activityEnvironment is stored.
+var activityEnvContextKey = activityEnvContextKeyType{}
+
+func getActivityEnv(ctx context.Context) *activityEnvironment {
+	env := ctx.Value(activityEnvContextKey)
+	if env == nil {
+		panic("getActivityEnv: not called from an activity context")
+	}
+	return env.(*activityEnvironment)
+}
+
+// RecordActivityTaskHeartbeat sends details about an activity's progress to
+// the Cadence server, canceling the activity's context if cancellation was requested.
+func RecordActivityTaskHeartbeat(ctx context.Context, details []byte) error {
+	env := getActivityEnv(ctx)
+	env.heartbeatMutex.Lock()
+	env.lastHeartbeatData = details
+	env.heartbeatMutex.Unlock()
+
+	request := &s.RecordActivityTaskHeartbeatRequest{
+		TaskToken: env.taskToken,
+		Details:   details,
+		Identity:  common.StringPtr(env.identity),
+	}
+
+	response, err := env.service.RecordActivityTaskHeartbeat(context.Background(), request)
+	if err != nil {
+		return err
+	}
+	if response.GetCancelRequested() && env.cancel != nil {
+		env.cancel()
+	}
+	return nil
+}
+
+// startHeartbeatIfNeeded periodically invokes RecordActivityTaskHeartbeat
+// until ctx is done. The returned func must be called to stop it.
+func startHeartbeatIfNeeded(ctx context.Context, env *activityEnvironment) func() {
+	if env.heartbeatInterval <= 0 {
+		return func() {}
+	}
+
+	stopCh := make(chan struct{})
+	ticker := time.NewTicker(env.heartbeatInterval)
+	go func() {
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				env.heartbeatMutex.Lock()
+				details := env.lastHeartbeatData
+				env.heartbeatMutex.Unlock()
+				RecordActivityTaskHeartbeat(ctx, details)
+			case <-ctx.Done():
+				return
+			case <-stopCh:
+				return
+			}
+		}
+	}()
+	return func() { close(stopCh) }
+}
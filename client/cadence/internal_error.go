@@ -0,0 +1,90 @@
+package cadence
+
+// All code in this file is private to the package, except for the
+// exported error types which form the structured error hierarchy
+// recognized by the workflow and activity task handlers.
+
+import (
+	"fmt"
+
+	s "code.uber.internal/devexp/minions-client-go.git/.gen/go/shared"
+)
+
+type (
+	// CustomError is an application-defined failure carrying a reason and
+	// opaque details.
+	CustomError struct {
+		reason  string
+		details []byte
+	}
+
+	// CanceledError indicates an activity or workflow execution was canceled.
+	CanceledError struct {
+		details []byte
+	}
+
+	// TimeoutError indicates that an activity or workflow timed out before
+	// completing.
+	TimeoutError struct {
+		timeoutType s.TimeoutType
+	}
+
+	// PanicError wraps a panic recovered from user workflow or activity code.
+	PanicError struct {
+		value      interface{}
+		stackTrace string
+	}
+
+	// GenericError wraps an arbitrary Go error without a reason/details pair.
+	GenericError struct {
+		err error
+	}
+)
+
+// NewCustomError creates a CustomError with the given reason and details.
+func NewCustomError(reason string, details []byte) *CustomError {
+	return &CustomError{reason: reason, details: details}
+}
+
+func (e *CustomError) Error() string   { return fmt.Sprintf("CustomError: %s", e.reason) }
+func (e *CustomError) Reason() string  { return e.reason }
+func (e *CustomError) Details() []byte { return e.details }
+
+// NewCanceledError creates a CanceledError carrying the last reported
+// progress details, if any.
+func NewCanceledError(details []byte) *CanceledError {
+	return &CanceledError{details: details}
+}
+
+func (e *CanceledError) Error() string   { return "CanceledError" }
+func (e *CanceledError) Reason() string  { return "cadenceInternal:Canceled" }
+func (e *CanceledError) Details() []byte { return e.details }
+
+// NewTimeoutError creates a TimeoutError for the given timeout type.
+func NewTimeoutError(timeoutType s.TimeoutType) *TimeoutError {
+	return &TimeoutError{timeoutType: timeoutType}
+}
+
+func (e *TimeoutError) Error() string   { return fmt.Sprintf("TimeoutType: %v", e.timeoutType) }
+func (e *TimeoutError) Reason() string  { return e.Error() }
+func (e *TimeoutError) Details() []byte { return nil }
+
+// newPanicError creates a PanicError from a recovered panic value and the
+// stack trace captured at the point of recovery.
+func newPanicError(value interface{}, stackTrace string) *PanicError {
+	return &PanicError{value: value, stackTrace: stackTrace}
+}
+
+func (e *PanicError) Error() string   { return fmt.Sprintf("PanicError: %v", e.value) }
+func (e *PanicError) Reason() string  { return e.Error() }
+func (e *PanicError) Details() []byte { return []byte(e.stackTrace) }
+
+// NewGenericError wraps a plain Go error so it satisfies the Error
+// interface expected by the task handlers.
+func NewGenericError(err error) *GenericError {
+	return &GenericError{err: err}
+}
+
+func (e *GenericError) Error() string   { return e.err.Error() }
+func (e *GenericError) Reason() string  { return e.err.Error() }
+func (e *GenericError) Details() []byte { return nil }
@@ -0,0 +1,68 @@
+package cadence
+
+// All code in this file is private to the package, except for the
+// exported interceptor interfaces that form the worker's extension point.
+
+import (
+	s "code.uber.internal/devexp/minions-client-go.git/.gen/go/shared"
+	"golang.org/x/net/context"
+)
+
+type (
+	// WorkerInterceptor lets callers observe and augment every workflow and
+	// activity task handled by a worker, without forking the handler code.
+	WorkerInterceptor interface {
+		// InterceptWorkflow returns a WorkflowInboundInterceptor wrapping next.
+		InterceptWorkflow(info *WorkflowInfo, next WorkflowInboundInterceptor) WorkflowInboundInterceptor
+		// InterceptActivity returns an ActivityInboundInterceptor wrapping next.
+		InterceptActivity(activityType ActivityType, next ActivityInboundInterceptor) ActivityInboundInterceptor
+	}
+
+	// WorkflowInboundInterceptor intercepts a single decision task.
+	WorkflowInboundInterceptor interface {
+		ExecuteDecisionTask(workflowTask *workflowTask, emitStack bool) (*s.RespondDecisionTaskCompletedRequest, string, error)
+	}
+
+	// ActivityInboundInterceptor intercepts a single activity task.
+	ActivityInboundInterceptor interface {
+		ExecuteActivity(ctx context.Context, task *activityTask) (interface{}, error)
+	}
+
+	// workflowTaskHandlerTerminal is the innermost WorkflowInboundInterceptor.
+	workflowTaskHandlerTerminal struct {
+		wth *workflowTaskHandlerImpl
+	}
+
+	// activityTaskHandlerTerminal is the innermost ActivityInboundInterceptor.
+	activityTaskHandlerTerminal struct {
+		ath *activityTaskHandlerImpl
+	}
+)
+
+func (t *workflowTaskHandlerTerminal) ExecuteDecisionTask(workflowTask *workflowTask, emitStack bool) (*s.RespondDecisionTaskCompletedRequest, string, error) {
+	return t.wth.processWorkflowTaskCore(workflowTask, emitStack)
+}
+
+func (t *activityTaskHandlerTerminal) ExecuteActivity(ctx context.Context, task *activityTask) (interface{}, error) {
+	return t.ath.executeCore(ctx, task)
+}
+
+// buildWorkflowInterceptorChain composes the registered WorkerInterceptors
+// around the handler's own terminal implementation, outermost first.
+func (wth *workflowTaskHandlerImpl) buildWorkflowInterceptorChain(info *WorkflowInfo) WorkflowInboundInterceptor {
+	var chain WorkflowInboundInterceptor = &workflowTaskHandlerTerminal{wth: wth}
+	for i := len(wth.interceptors) - 1; i >= 0; i-- {
+		chain = wth.interceptors[i].InterceptWorkflow(info, chain)
+	}
+	return chain
+}
+
+// buildActivityInterceptorChain composes the registered WorkerInterceptors
+// around the handler's own terminal implementation, outermost first.
+func (ath *activityTaskHandlerImpl) buildActivityInterceptorChain(activityType ActivityType) ActivityInboundInterceptor {
+	var chain ActivityInboundInterceptor = &activityTaskHandlerTerminal{ath: ath}
+	for i := len(ath.interceptors) - 1; i >= 0; i-- {
+		chain = ath.interceptors[i].InterceptActivity(activityType, chain)
+	}
+	return chain
+}
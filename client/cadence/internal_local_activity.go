@@ -0,0 +1,329 @@
+package cadence
+
+// All code in this file is private to the package.
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	s "code.uber.internal/devexp/minions-client-go.git/.gen/go/shared"
+	"code.uber.internal/devexp/minions-client-go.git/common"
+	"golang.org/x/net/context"
+)
+
+// localActivityMarkerName is the marker name under which local activity
+// results are recorded in workflow history.
+const localActivityMarkerName = "LocalActivity"
+
+// maxLocalActivityExecutionBudget bounds how long a decision task spends
+// executing local activities before forcing a new decision task.
+const maxLocalActivityExecutionBudget = 2 * time.Second
+
+type (
+	// LocalActivityOptions configures a local activity invocation, executed
+	// in-process instead of going through the server for scheduling.
+	LocalActivityOptions struct {
+		// ScheduleToCloseTimeout is the maximum duration allowed for a
+		// local activity execution, including retries.
+		ScheduleToCloseTimeout time.Duration
+
+		// RetryPolicy controls how a failed local activity is retried
+		// in-process before the error is surfaced to the workflow.
+		RetryPolicy *RetryPolicy
+	}
+
+	// RetryPolicy defines the retry behavior for a local activity.
+	RetryPolicy struct {
+		// InitialInterval is the backoff interval before the first retry.
+		InitialInterval time.Duration
+		// BackoffCoefficient multiplies the interval after each attempt.
+		BackoffCoefficient float64
+		// MaximumInterval caps the backoff interval.
+		MaximumInterval time.Duration
+		// MaximumAttempts caps the number of attempts, 0 means unlimited.
+		MaximumAttempts int
+	}
+
+	// Future represents the result of an asynchronous local activity.
+	// Workflow code calls Get to block until the result is available.
+	Future interface {
+		// Get blocks until ready, then unmarshals the result into valuePtr
+		// (if non-nil) and returns any error the activity failed with.
+		Get(ctx context.Context, valuePtr interface{}) error
+		// IsReady reports whether the result is available without blocking.
+		IsReady() bool
+	}
+
+	// localActivityFuture is the Future returned by ExecuteLocalActivity.
+	localActivityFuture struct {
+		ready  chan struct{}
+		result []byte
+		err    Error
+	}
+
+	// localActivityTask wraps a single local activity request queued by
+	// workflow code during event replay/execution.
+	localActivityTask struct {
+		activityID   string
+		activityType ActivityType
+		input        []byte
+		options      LocalActivityOptions
+		future       *localActivityFuture
+	}
+
+	// localActivityResult carries the outcome of a single local activity
+	// attempt, ready to be recorded as a marker decision.
+	localActivityResult struct {
+		task    *localActivityTask
+		result  []byte
+		err     Error
+		attempt int
+		elapsed time.Duration
+	}
+
+	// localActivityMarkerData is the payload serialized into a
+	// MarkerRecorded decision's Details so that replay can reconstruct the
+	// local activity outcome deterministically without re-executing it.
+	localActivityMarkerData struct {
+		ActivityID   string
+		ActivityType string
+		Attempt      int
+		ElapsedNanos int64
+		Input        []byte `json:",omitempty"`
+		Result       []byte `json:",omitempty"`
+		ErrReason    string `json:",omitempty"`
+		ErrDetails   []byte `json:",omitempty"`
+	}
+
+	// localActivityTaskHandler executes local activities in-process,
+	// reusing the same Activity implementations registered for regular
+	// activities.
+	localActivityTaskHandler struct {
+		implementations map[ActivityType]Activity
+		identity        string
+	}
+
+	// localActivityTaskCollector accumulates local activities scheduled
+	// during a single decision task until they are drained and executed.
+	localActivityTaskCollector struct {
+		mu    sync.Mutex
+		tasks []*localActivityTask
+	}
+
+	// localActivityCollectorContextKeyType is the unexported type used to
+	// store the localActivityTaskCollector on a context.Context.
+	localActivityCollectorContextKeyType struct{}
+)
+
+// localActivityCollectorContextKey is the context.Context key under which
+// the current decision task's localActivityTaskCollector is stored.
+var localActivityCollectorContextKey = localActivityCollectorContextKeyType{}
+
+// newLocalActivityFuture returns an unresolved Future.
+func newLocalActivityFuture() *localActivityFuture {
+	return &localActivityFuture{ready: make(chan struct{})}
+}
+
+// set resolves the future with the activity's outcome. Called exactly once.
+func (f *localActivityFuture) set(result []byte, err Error) {
+	f.result = result
+	f.err = err
+	close(f.ready)
+}
+
+func (f *localActivityFuture) IsReady() bool {
+	select {
+	case <-f.ready:
+		return true
+	default:
+		return false
+	}
+}
+
+func (f *localActivityFuture) Get(ctx context.Context, valuePtr interface{}) error {
+	select {
+	case <-f.ready:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	if f.err != nil {
+		return f.err
+	}
+	if valuePtr != nil {
+		return json.Unmarshal(f.result, valuePtr)
+	}
+	return nil
+}
+
+// newLocalActivityTaskCollector returns an empty collector.
+func newLocalActivityTaskCollector() *localActivityTaskCollector {
+	return &localActivityTaskCollector{}
+}
+
+// withLocalActivityTaskCollector binds collector to ctx for ExecuteLocalActivity.
+func withLocalActivityTaskCollector(ctx context.Context, collector *localActivityTaskCollector) context.Context {
+	return context.WithValue(ctx, localActivityCollectorContextKey, collector)
+}
+
+// drain returns and clears all tasks scheduled so far.
+func (c *localActivityTaskCollector) drain() []*localActivityTask {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	tasks := c.tasks
+	c.tasks = nil
+	return tasks
+}
+
+// requeue pushes tasks drained but not executed back onto the front of the
+// collector, so the next drain returns them before any newly scheduled
+// local activities.
+func (c *localActivityTaskCollector) requeue(tasks []*localActivityTask) {
+	if len(tasks) == 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.tasks = append(tasks, c.tasks...)
+}
+
+// schedule enqueues a local activity for in-process execution when the
+// collector is next drained and returns a Future for its result. Tasks left
+// over once the per-decision-task budget is spent are requeued rather than
+// run in the current decision task.
+func (c *localActivityTaskCollector) schedule(activityType ActivityType, input []byte, options LocalActivityOptions) Future {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	future := newLocalActivityFuture()
+	c.tasks = append(c.tasks, &localActivityTask{
+		activityID:   fmt.Sprintf("%s-%d", activityType.Name, len(c.tasks)+1),
+		activityType: activityType,
+		input:        input,
+		options:      options,
+		future:       future,
+	})
+	return future
+}
+
+// ExecuteLocalActivity schedules activityType to run in-process, bypassing
+// the server round-trip used for regular activities, and returns a Future
+// for its result. The outcome is recorded as a marker in workflow history so
+// replay can reconstruct the Future's result without re-executing it.
+func ExecuteLocalActivity(ctx context.Context, activityType ActivityType, input []byte, options LocalActivityOptions) (Future, error) {
+	collector, ok := ctx.Value(localActivityCollectorContextKey).(*localActivityTaskCollector)
+	if !ok {
+		return nil, fmt.Errorf("ExecuteLocalActivity: not called from a workflow context")
+	}
+	return collector.schedule(activityType, input, options), nil
+}
+
+// newLocalActivityTaskHandler returns a handler that executes local
+// activities in-process using the supplied activity implementations.
+func newLocalActivityTaskHandler(implementations map[ActivityType]Activity, identity string) *localActivityTaskHandler {
+	return &localActivityTaskHandler{implementations: implementations, identity: identity}
+}
+
+// executeLocalActivityTask runs a local activity in-process, retrying per
+// task.options.RetryPolicy until it succeeds or ScheduleToCloseTimeout elapses.
+func (lath *localActivityTaskHandler) executeLocalActivityTask(task *localActivityTask) *localActivityResult {
+	startTime := time.Now()
+
+	var deadline time.Time
+	if task.options.ScheduleToCloseTimeout > 0 {
+		deadline = startTime.Add(task.options.ScheduleToCloseTimeout)
+	}
+
+	activityImplementation, ok := lath.implementations[task.activityType]
+	if !ok {
+		return &localActivityResult{
+			task:    task,
+			attempt: 1,
+			elapsed: time.Now().Sub(startTime),
+			err:     NewGenericError(fmt.Errorf("No implementation for local activityType=%v", task.activityType)),
+		}
+	}
+
+	execCtx := context.Background()
+	if !deadline.IsZero() {
+		var cancel context.CancelFunc
+		execCtx, cancel = context.WithDeadline(execCtx, deadline)
+		defer cancel()
+	}
+
+	interval := time.Duration(0)
+	if task.options.RetryPolicy != nil {
+		interval = task.options.RetryPolicy.InitialInterval
+	}
+
+	attempt := 0
+	for {
+		attempt++
+		output, err := activityImplementation.Execute(execCtx, task.input)
+		if err == nil || !lath.shouldRetry(task.options.RetryPolicy, attempt, deadline) {
+			return &localActivityResult{
+				task:    task,
+				result:  output,
+				err:     err,
+				attempt: attempt,
+				elapsed: time.Now().Sub(startTime),
+			}
+		}
+
+		time.Sleep(interval)
+		interval = time.Duration(float64(interval) * task.options.RetryPolicy.BackoffCoefficient)
+		if task.options.RetryPolicy.MaximumInterval > 0 && interval > task.options.RetryPolicy.MaximumInterval {
+			interval = task.options.RetryPolicy.MaximumInterval
+		}
+	}
+}
+
+// shouldRetry reports whether another attempt should be made given policy,
+// the number of attempts already made, and the schedule-to-close deadline.
+func (lath *localActivityTaskHandler) shouldRetry(policy *RetryPolicy, attempt int, deadline time.Time) bool {
+	if policy == nil {
+		return false
+	}
+	if policy.MaximumAttempts > 0 && attempt >= policy.MaximumAttempts {
+		return false
+	}
+	if !deadline.IsZero() && !time.Now().Before(deadline) {
+		return false
+	}
+	return true
+}
+
+// newLocalActivityMarkerDecision builds the MarkerRecorded decision that
+// durably records a local activity's outcome for replay.
+func newLocalActivityMarkerDecision(r *localActivityResult) (*s.Decision, error) {
+	data := &localActivityMarkerData{
+		ActivityID:   r.task.activityID,
+		ActivityType: r.task.activityType.Name,
+		Attempt:      r.attempt,
+		ElapsedNanos: r.elapsed.Nanoseconds(),
+		Input:        r.task.input,
+		Result:       r.result,
+	}
+	if r.err != nil {
+		data.ErrReason = r.err.Reason()
+		data.ErrDetails = r.err.Details()
+	}
+
+	details, err := json.Marshal(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to serialize local activity marker: %v", err)
+	}
+
+	decision := createNewDecision(s.DecisionType_RecordMarker)
+	decision.RecordMarkerDecisionAttributes = &s.RecordMarkerDecisionAttributes{
+		MarkerName: common.StringPtr(localActivityMarkerName),
+		Details:    details,
+	}
+	return decision, nil
+}
+
+// shouldForceNewDecisionTask reports whether spent has exceeded the
+// per-decision-task local activity execution budget.
+func shouldForceNewDecisionTask(spent time.Duration) bool {
+	return spent >= maxLocalActivityExecutionBudget
+}
@@ -0,0 +1,152 @@
+package cadence
+
+// All code in this file is private to the package.
+
+import (
+	"io"
+	"math/rand"
+	"net"
+	"time"
+
+	"github.com/uber-go/tally"
+	"golang.org/x/net/context"
+	"golang.org/x/time/rate"
+
+	m "code.uber.internal/devexp/minions-client-go.git/.gen/go/minions"
+	s "code.uber.internal/devexp/minions-client-go.git/.gen/go/shared"
+	"code.uber.internal/devexp/minions-client-go.git/common/metrics"
+)
+
+const (
+	retryServiceOperationInitialInterval    = 50 * time.Millisecond
+	retryServiceOperationMaxInterval        = 10 * time.Second
+	retryServiceOperationBackoffCoefficient = 2.0
+	retryServiceOperationMaxAttempts        = 5
+
+	// ratelimit on outbound calls so a retry storm from one worker can't
+	// overwhelm the server during an incident.
+	defaultServiceRateLimit = 100
+)
+
+type (
+	// retryableService wraps a TChanWorkflowService with retry, rate
+	// limiting, and metrics. Non-overridden methods fall through unmodified.
+	retryableService struct {
+		m.TChanWorkflowService
+		limiter      *rate.Limiter
+		metricsScope tally.Scope
+	}
+)
+
+// newRetryableService wraps service with a retrying, rate-limited,
+// metrics-emitting transport.
+func newRetryableService(service m.TChanWorkflowService, metricsScope tally.Scope) m.TChanWorkflowService {
+	return &retryableService{
+		TChanWorkflowService: service,
+		limiter:              rate.NewLimiter(rate.Limit(defaultServiceRateLimit), defaultServiceRateLimit),
+		metricsScope:         metricsScope,
+	}
+}
+
+// isRetryableServiceError classifies whether err is a transient failure
+// (network blip, server busy, throttling) worth retrying, as opposed to a
+// permanent failure that should be surfaced immediately.
+func isRetryableServiceError(err error) bool {
+	if err == nil {
+		return false
+	}
+	switch err.(type) {
+	case *s.ServiceBusyError:
+		return true
+	case *s.InternalServiceError:
+		return true
+	}
+	if err == io.EOF {
+		return true
+	}
+	if netErr, ok := err.(net.Error); ok {
+		return netErr.Timeout() || netErr.Temporary()
+	}
+	return false
+}
+
+// callWithRetry executes op, retrying with exponential backoff and jitter
+// while isRetryableServiceError(err) holds, making at most
+// retryServiceOperationMaxAttempts attempts in all.
+func (c *retryableService) callWithRetry(ctx context.Context, rpcName string, op func() error) error {
+	taggedScope := c.taggedMetricsScope(rpcName)
+	interval := retryServiceOperationInitialInterval
+
+	var err error
+	for attempt := 0; attempt < retryServiceOperationMaxAttempts; attempt++ {
+		if waitErr := c.limiter.Wait(ctx); waitErr != nil {
+			return waitErr
+		}
+
+		start := time.Now()
+		err = op()
+		if taggedScope != nil {
+			taggedScope.Timer(metrics.ServiceRequestLatency).Record(time.Now().Sub(start))
+		}
+
+		if err == nil {
+			return nil
+		}
+		if taggedScope != nil {
+			taggedScope.Counter(metrics.ServiceErrorCounter).Inc(1)
+		}
+		if !isRetryableServiceError(err) {
+			return err
+		}
+
+		backoff := time.Duration(float64(interval) * (0.5 + rand.Float64()))
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		interval = time.Duration(float64(interval) * retryServiceOperationBackoffCoefficient)
+		if interval > retryServiceOperationMaxInterval {
+			interval = retryServiceOperationMaxInterval
+		}
+	}
+	return err
+}
+
+func (c *retryableService) taggedMetricsScope(rpcName string) tally.Scope {
+	if c.metricsScope == nil {
+		return nil
+	}
+	return c.metricsScope.Tagged(map[string]string{"RPCName": rpcName})
+}
+
+// RecordActivityTaskHeartbeat wraps the embedded service's call with retry, rate limiting, and metrics.
+func (c *retryableService) RecordActivityTaskHeartbeat(ctx context.Context, request *s.RecordActivityTaskHeartbeatRequest) (response *s.RecordActivityTaskHeartbeatResponse, err error) {
+	err = c.callWithRetry(ctx, "RecordActivityTaskHeartbeat", func() error {
+		var innerErr error
+		response, innerErr = c.TChanWorkflowService.RecordActivityTaskHeartbeat(ctx, request)
+		return innerErr
+	})
+	return response, err
+}
+
+// RespondActivityTaskCompleted wraps the embedded service's call with retry, rate limiting, and metrics.
+func (c *retryableService) RespondActivityTaskCompleted(ctx context.Context, request *s.RespondActivityTaskCompletedRequest) error {
+	return c.callWithRetry(ctx, "RespondActivityTaskCompleted", func() error {
+		return c.TChanWorkflowService.RespondActivityTaskCompleted(ctx, request)
+	})
+}
+
+// RespondActivityTaskFailed wraps the embedded service's call with retry, rate limiting, and metrics.
+func (c *retryableService) RespondActivityTaskFailed(ctx context.Context, request *s.RespondActivityTaskFailedRequest) error {
+	return c.callWithRetry(ctx, "RespondActivityTaskFailed", func() error {
+		return c.TChanWorkflowService.RespondActivityTaskFailed(ctx, request)
+	})
+}
+
+// RespondActivityTaskCanceled wraps the embedded service's call with retry, rate limiting, and metrics.
+func (c *retryableService) RespondActivityTaskCanceled(ctx context.Context, request *s.RespondActivityTaskCanceledRequest) error {
+	return c.callWithRetry(ctx, "RespondActivityTaskCanceled", func() error {
+		return c.TChanWorkflowService.RespondActivityTaskCanceled(ctx, request)
+	})
+}
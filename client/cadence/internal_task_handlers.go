@@ -5,6 +5,7 @@ package cadence
 import (
 	"fmt"
 	"reflect"
+	"runtime/debug"
 	"time"
 
 	"github.com/uber-common/bark"
@@ -39,6 +40,20 @@ type (
 	workflowExecutionEventHandler interface {
 		// Process a single event and return the assosciated decisions.
 		ProcessEvent(event *s.HistoryEvent) ([]*s.Decision, error)
+		// CollectLocalActivityTasks drains the local activities requested by
+		// workflow code while processing events so they can be executed
+		// in-process before the decision task is completed.
+		CollectLocalActivityTasks() []*localActivityTask
+		// RequeueLocalActivityTasks pushes tasks drained but not executed
+		// back onto the front of the pending local activity queue, so the
+		// next CollectLocalActivityTasks on this same handler returns them
+		// first. They are lost if the handler is not reused.
+		RequeueLocalActivityTasks(tasks []*localActivityTask)
+		// SetCompleteHandler rebinds the completion callback invoked when
+		// the workflow completes. This is used when a cached handler is
+		// reused across decision tasks under sticky execution, since each
+		// decision task needs its own completion state.
+		SetCompleteHandler(completeHandler func(result []byte, err Error))
 		StackTrace() string
 		// Close for cleaning up resources on this event handler
 		Close()
@@ -58,71 +73,36 @@ type (
 type (
 	// workflowTaskHandlerImpl is the implementation of workflowTaskHandler
 	workflowTaskHandlerImpl struct {
-		taskListName       string
-		identity           string
-		workflowDefFactory workflowDefinitionFactory
-		metricsScope       tally.Scope
-		ppMgr              pressurePointMgr
-		logger             bark.Logger
+		taskListName             string
+		identity                 string
+		workflowDefFactory       workflowDefinitionFactory
+		metricsScope             tally.Scope
+		ppMgr                    pressurePointMgr
+		logger                   bark.Logger
+		localActivityTaskHandler *localActivityTaskHandler
+		stickyCache              workflowExecutionCache
+		stickyTaskListName       string
+		interceptors             []WorkerInterceptor
 	}
 
 	// activityTaskHandlerImpl is the implementation of ActivityTaskHandler
 	activityTaskHandlerImpl struct {
-		taskListName    string
-		identity        string
-		implementations map[ActivityType]Activity
-		service         m.TChanWorkflowService
-		metricsScope    tally.Scope
-		logger          bark.Logger
+		taskListName      string
+		identity          string
+		implementations   map[ActivityType]Activity
+		service           m.TChanWorkflowService
+		metricsScope      tally.Scope
+		logger            bark.Logger
+		heartbeatInterval time.Duration
+		interceptors      []WorkerInterceptor
 	}
 
 	// eventsHelper wrapper method to help information about events.
 	eventsHelper struct {
 		workflowTask *workflowTask
 	}
-
-	// activityTaskFailedError wraps the details of the failure of activity
-	activityTaskFailedError struct {
-		reason  string
-		details []byte
-	}
-
-	// activityTaskTimeoutError wraps the details of the timeout of activity
-	activityTaskTimeoutError struct {
-		TimeoutType s.TimeoutType
-	}
 )
 
-// Error from error.Error
-func (e activityTaskFailedError) Error() string {
-	return fmt.Sprintf("Reason: %s, Details: %s", e.reason, e.details)
-}
-
-// Details of the error
-func (e activityTaskFailedError) Details() []byte {
-	return e.details
-}
-
-// Reason of the error
-func (e activityTaskFailedError) Reason() string {
-	return e.reason
-}
-
-// Error from error.Error
-func (e activityTaskTimeoutError) Error() string {
-	return fmt.Sprintf("TimeoutType: %v", e.TimeoutType)
-}
-
-// Details of the error
-func (e activityTaskTimeoutError) Details() []byte {
-	return nil
-}
-
-// Reason of the error
-func (e activityTaskTimeoutError) Reason() string {
-	return e.Error()
-}
-
 // Get last non replayed event ID.
 func (eh eventsHelper) LastNonReplayedID() int64 {
 	if eh.workflowTask.task.PreviousStartedEventId == nil {
@@ -143,38 +123,105 @@ func newWorkflowTaskHandler(taskListName string, identity string, factory workfl
 		metricsScope:       metricsScope}
 }
 
-// ProcessWorkflowTask processes each all the events of the workflow task.
+// withLocalActivities enables local activity execution on the workflow task
+// handler, using the supplied implementations to run local activities
+// in-process rather than scheduling them through the server.
+func (wth *workflowTaskHandlerImpl) withLocalActivities(implementations map[ActivityType]Activity) *workflowTaskHandlerImpl {
+	wth.localActivityTaskHandler = newLocalActivityTaskHandler(implementations, wth.identity)
+	return wth
+}
+
+// withStickyCache enables sticky execution: the workflowExecutionEventHandler
+// constructed for a RunID is kept warm in a size-bounded LRU so that
+// subsequent decision tasks carrying only new events can resume it instead
+// of replaying full history. stickyTaskListName is advertised to the server
+// so it can route follow-up decision tasks for this RunID back here.
+func (wth *workflowTaskHandlerImpl) withStickyCache(cache workflowExecutionCache, stickyTaskListName string) *workflowTaskHandlerImpl {
+	wth.stickyCache = cache
+	wth.stickyTaskListName = stickyTaskListName
+	return wth
+}
+
+// errStickyCacheMiss is returned when a decision task claims there is
+// previously-started history (PreviousStartedEventId > 0) but no cached
+// handler is found for its RunID. The caller should fall back to requesting
+// a decision task with full history from the server and retry.
+var errStickyCacheMiss = fmt.Errorf("sticky cache miss: full history required")
+
+// withWorkerInterceptors registers the given interceptors on the workflow
+// task handler, composed in the order supplied: the first interceptor is
+// outermost and sees the task before any other.
+func (wth *workflowTaskHandlerImpl) withWorkerInterceptors(interceptors []WorkerInterceptor) *workflowTaskHandlerImpl {
+	wth.interceptors = interceptors
+	return wth
+}
+
+// ProcessWorkflowTask processes each all the events of the workflow task,
+// running it through any registered WorkerInterceptors.
 func (wth *workflowTaskHandlerImpl) ProcessWorkflowTask(workflowTask *workflowTask, emitStack bool) (result *s.RespondDecisionTaskCompletedRequest, stackTrace string, err error) {
 	if workflowTask == nil {
 		return nil, "", fmt.Errorf("nil workflowtask provided")
 	}
 
-	wth.logger.Debugf("Processing New Workflow Task: Type=%s, PreviousStartedEventId=%d",
-		workflowTask.task.GetWorkflowType().GetName(), workflowTask.task.GetPreviousStartedEventId())
-
-	// Setup workflow Info
 	workflowInfo := &WorkflowInfo{
 		WorkflowType: flowWorkflowTypeFrom(*workflowTask.task.WorkflowType),
 		TaskListName: wth.taskListName,
 		// workflowExecution
 	}
+	chain := wth.buildWorkflowInterceptorChain(workflowInfo)
+	return chain.ExecuteDecisionTask(workflowTask, emitStack)
+}
 
-	isWorkflowCompleted := false
+// processWorkflowTaskCore is the innermost implementation of
+// ProcessWorkflowTask, invoked as the terminal step of the interceptor
+// chain.
+func (wth *workflowTaskHandlerImpl) processWorkflowTaskCore(workflowTask *workflowTask, emitStack bool) (result *s.RespondDecisionTaskCompletedRequest, stackTrace string, err error) {
+	wth.logger.Debugf("Processing New Workflow Task: Type=%s, PreviousStartedEventId=%d",
+		workflowTask.task.GetWorkflowType().GetName(), workflowTask.task.GetPreviousStartedEventId())
+
+	runID := workflowTask.task.GetWorkflowExecution().GetRunId()
+	isSticky := wth.stickyCache != nil
+
+	var eventHandler workflowExecutionEventHandler
+	var isWorkflowCompleted bool
 	var completionResult []byte
 	var failure Error
 
+	if isSticky {
+		if cached, ok := wth.stickyCache.Get(runID); ok {
+			eventHandler = cached
+		} else if workflowTask.task.GetPreviousStartedEventId() > 0 {
+			// The server believes we have cached state for this RunID but
+			// we don't (e.g. worker restart or eviction); ask for full
+			// history instead of replaying from a blank handler.
+			return nil, "", errStickyCacheMiss
+		}
+	}
+
 	completeHandler := func(result []byte, err Error) {
 		completionResult = result
 		failure = err
 		isWorkflowCompleted = true
 	}
 
-	eventHandler := newWorkflowExecutionEventHandler(
-		workflowInfo, wth.workflowDefFactory, completeHandler, wth.logger)
+	if eventHandler == nil {
+		// Setup workflow Info
+		workflowInfo := &WorkflowInfo{
+			WorkflowType: flowWorkflowTypeFrom(*workflowTask.task.WorkflowType),
+			TaskListName: wth.taskListName,
+			// workflowExecution
+		}
+		eventHandler = newWorkflowExecutionEventHandler(
+			workflowInfo, wth.workflowDefFactory, completeHandler, wth.logger)
+	} else {
+		eventHandler.SetCompleteHandler(completeHandler)
+	}
 	helperEvents := &eventsHelper{workflowTask: workflowTask}
 	history := workflowTask.task.History
 	decisions := []*s.Decision{}
 
+	taggedScope := wth.taggedMetricsScope(workflowTask.task.GetWorkflowType().GetName())
+
 	startTime := time.Now()
 
 	// Process events
@@ -184,24 +231,45 @@ func (wth *workflowTaskHandlerImpl) ProcessWorkflowTask(workflowTask *workflowTa
 		isInReplay := event.GetEventId() < helperEvents.LastNonReplayedID()
 
 		// Any metrics.
-		if wth.metricsScope != nil && !isInReplay {
+		if taggedScope != nil && !isInReplay {
 			switch event.GetEventType() {
 			case s.EventType_DecisionTaskTimedOut:
-				wth.metricsScope.Counter(metrics.DecisionsTimeoutCounter).Inc(1)
+				taggedScope.Counter(metrics.DecisionsTimeoutCounter).Inc(1)
+			case s.EventType_WorkflowExecutionStarted:
+				taggedScope.Counter(metrics.WorkflowsStartTotalCounter).Inc(1)
 			}
 		}
 
 		// Any pressure points.
 		err := wth.executeAnyPressurePoints(event, isInReplay)
 		if err != nil {
+			wth.evictStickyCacheOnError(isSticky, runID)
 			return nil, "", err
 		}
 
-		eventDecisions, err := eventHandler.ProcessEvent(event)
+		eventStartTime := time.Now()
+		eventDecisions, panicErr, err := wth.processEventSafely(eventHandler, event)
 		if err != nil {
+			wth.evictStickyCacheOnError(isSticky, runID)
 			return nil, "", err
 		}
 
+		if taggedScope != nil {
+			replayTagged := taggedScope.Tagged(map[string]string{"Replay": fmt.Sprintf("%v", isInReplay)})
+			replayTagged.Timer(metrics.DecisionExecutionLatency).Record(time.Now().Sub(eventStartTime))
+		}
+
+		if panicErr != nil {
+			// A panic in user workflow code fails the workflow execution
+			// rather than crashing the worker.
+			if taggedScope != nil {
+				taggedScope.Counter(metrics.UnhandledPanicCounter).Inc(1)
+			}
+			failure = panicErr
+			isWorkflowCompleted = true
+			break
+		}
+
 		if !isInReplay {
 			if eventDecisions != nil {
 				decisions = append(decisions, eventDecisions...)
@@ -209,14 +277,36 @@ func (wth *workflowTaskHandlerImpl) ProcessWorkflowTask(workflowTask *workflowTa
 		}
 	}
 
+	localActivityDecisions, forceNewDecisionTask, err := wth.executeLocalActivities(eventHandler)
+	if err != nil {
+		wth.evictStickyCacheOnError(isSticky, runID)
+		return nil, "", err
+	}
+	decisions = append(decisions, localActivityDecisions...)
+
 	eventDecisions := wth.completeWorkflow(isWorkflowCompleted, completionResult, failure)
 	if len(eventDecisions) > 0 {
 		decisions = append(decisions, eventDecisions...)
 
-		if wth.metricsScope != nil {
-			wth.metricsScope.Counter(metrics.WorkflowsCompletionTotalCounter).Inc(1)
+		if taggedScope != nil {
+			taggedScope.Counter(metrics.WorkflowsCompletionTotalCounter).Inc(1)
 			elapsed := time.Now().Sub(startTime)
-			wth.metricsScope.Timer(metrics.WorkflowEndToEndLatency).Record(elapsed)
+			taggedScope.Timer(metrics.WorkflowEndToEndLatency).Record(elapsed)
+		}
+	}
+
+	// Capture the stack trace before the handler is potentially evicted
+	// (and closed) below, since StackTrace() is not valid to call on a
+	// closed handler.
+	if emitStack {
+		stackTrace = eventHandler.StackTrace()
+	}
+
+	if isSticky {
+		if isWorkflowCompleted {
+			wth.stickyCache.Evict(runID)
+		} else {
+			wth.stickyCache.Put(runID, eventHandler)
 		}
 	}
 
@@ -227,16 +317,38 @@ func (wth *workflowTaskHandlerImpl) ProcessWorkflowTask(workflowTask *workflowTa
 		Identity:  common.StringPtr(wth.identity),
 		// ExecutionContext:
 	}
-	if emitStack {
-		stackTrace = eventHandler.StackTrace()
+	if forceNewDecisionTask {
+		taskCompletionRequest.ForceCreateNewDecisionTask = common.BoolPtr(true)
+	}
+	if isSticky && !isWorkflowCompleted {
+		taskCompletionRequest.StickyTaskListName = common.StringPtr(wth.stickyTaskListName)
 	}
 	return taskCompletionRequest, stackTrace, nil
 }
 
+// evictStickyCacheOnError evicts (and closes) the cached handler for runID
+// when sticky execution is enabled and this decision task is about to be
+// abandoned due to an error. Without this, a handler that failed to fully
+// apply the current batch of events would be handed back out on the run's
+// next decision task, resuming from inconsistent state.
+func (wth *workflowTaskHandlerImpl) evictStickyCacheOnError(isSticky bool, runID string) {
+	if isSticky {
+		wth.stickyCache.Evict(runID)
+	}
+}
+
 func (wth *workflowTaskHandlerImpl) completeWorkflow(isWorkflowCompleted bool, completionResult []byte,
 	err Error) []*s.Decision {
 	decisions := []*s.Decision{}
-	if err != nil {
+	if canceledErr, ok := err.(*CanceledError); ok {
+		// A CanceledError reports the workflow's execution as canceled
+		// rather than failed.
+		cancelDecision := createNewDecision(s.DecisionType_CancelWorkflowExecution)
+		cancelDecision.CancelWorkflowExecutionDecisionAttributes = &s.CancelWorkflowExecutionDecisionAttributes{
+			Details: canceledErr.Details(),
+		}
+		decisions = append(decisions, cancelDecision)
+	} else if err != nil {
 		// Workflow failures
 		failDecision := createNewDecision(s.DecisionType_FailWorkflowExecution)
 		failDecision.FailWorkflowExecutionDecisionAttributes = &s.FailWorkflowExecutionDecisionAttributes{
@@ -255,6 +367,64 @@ func (wth *workflowTaskHandlerImpl) completeWorkflow(isWorkflowCompleted bool, c
 	return decisions
 }
 
+// executeLocalActivities drains and runs, in-process, the local activities
+// requested while processing this decision task's events.
+func (wth *workflowTaskHandlerImpl) executeLocalActivities(eventHandler workflowExecutionEventHandler) ([]*s.Decision, bool, error) {
+	if wth.localActivityTaskHandler == nil {
+		return nil, false, nil
+	}
+
+	decisions := []*s.Decision{}
+	spent := time.Duration(0)
+	tasks := eventHandler.CollectLocalActivityTasks()
+	for i, task := range tasks {
+		if shouldForceNewDecisionTask(spent) {
+			eventHandler.RequeueLocalActivityTasks(tasks[i:])
+			return decisions, true, nil
+		}
+
+		result := wth.localActivityTaskHandler.executeLocalActivityTask(task)
+		spent += result.elapsed
+		task.future.set(result.result, result.err)
+
+		decision, err := newLocalActivityMarkerDecision(result)
+		if err != nil {
+			eventHandler.RequeueLocalActivityTasks(tasks[i+1:])
+			return nil, false, err
+		}
+		decisions = append(decisions, decision)
+	}
+	return decisions, false, nil
+}
+
+// taggedMetricsScope returns the handler's metrics scope tagged with the
+// workflow type and task list name so callers can slice decision task
+// metrics per workflow type on dashboards. Returns nil if no metrics scope
+// was configured.
+func (wth *workflowTaskHandlerImpl) taggedMetricsScope(workflowTypeName string) tally.Scope {
+	if wth.metricsScope == nil {
+		return nil
+	}
+	return wth.metricsScope.Tagged(map[string]string{
+		"WorkflowType": workflowTypeName,
+		"TaskListName": wth.taskListName,
+	})
+}
+
+// processEventSafely processes a single history event, recovering any panic
+// raised from user workflow code and converting it into a PanicError rather
+// than letting it crash the worker.
+func (wth *workflowTaskHandlerImpl) processEventSafely(eventHandler workflowExecutionEventHandler, event *s.HistoryEvent) (decisions []*s.Decision, panicErr Error, err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			wth.logger.Errorf("Workflow panic: %v, Stack: %s", p, debug.Stack())
+			panicErr = newPanicError(p, string(debug.Stack()))
+		}
+	}()
+	decisions, err = eventHandler.ProcessEvent(event)
+	return
+}
+
 func (wth *workflowTaskHandlerImpl) executeAnyPressurePoints(event *s.HistoryEvent, isInReplay bool) error {
 	if wth.ppMgr != nil && !reflect.ValueOf(wth.ppMgr).IsNil() && !isInReplay {
 		switch event.GetEventType() {
@@ -279,18 +449,76 @@ func newActivityTaskHandler(taskListName string, identity string, activities []A
 		taskListName:    taskListName,
 		identity:        identity,
 		implementations: implementations,
-		service:         service,
+		service:         newRetryableService(service, metricsScope),
 		logger:          logger,
 		metricsScope:    metricsScope}
 }
 
-// Execute executes an implementation of the activity.
+// taggedMetricsScope returns the handler's metrics scope tagged with the
+// activity type and task list name so callers can slice activity metrics
+// per activity type on dashboards. Returns nil if no metrics scope was
+// configured.
+func (ath *activityTaskHandlerImpl) taggedMetricsScope(activityTypeName string) tally.Scope {
+	if ath.metricsScope == nil {
+		return nil
+	}
+	return ath.metricsScope.Tagged(map[string]string{
+		"ActivityType": activityTypeName,
+		"TaskListName": ath.taskListName,
+	})
+}
+
+// executeSafely runs the activity implementation, recovering any panic
+// raised from user activity code and converting it into a PanicError rather
+// than letting it crash the worker.
+func (ath *activityTaskHandlerImpl) executeSafely(ctx context.Context, activityImplementation Activity, input []byte, taggedScope tally.Scope) (output []byte, err Error) {
+	defer func() {
+		if p := recover(); p != nil {
+			ath.logger.Errorf("Activity panic: %v, Stack: %s", p, debug.Stack())
+			if taggedScope != nil {
+				taggedScope.Counter(metrics.UnhandledPanicCounter).Inc(1)
+			}
+			err = newPanicError(p, string(debug.Stack()))
+		}
+	}()
+	return activityImplementation.Execute(ctx, input)
+}
+
+// withHeartbeating enables automatic periodic heartbeating of activities
+// executed by this handler, at the given interval, carrying the most
+// recently reported progress details.
+func (ath *activityTaskHandlerImpl) withHeartbeating(interval time.Duration) *activityTaskHandlerImpl {
+	ath.heartbeatInterval = interval
+	return ath
+}
+
+// withWorkerInterceptors registers the given interceptors on the activity
+// task handler, composed in the order supplied: the first interceptor is
+// outermost and sees the task before any other.
+func (ath *activityTaskHandlerImpl) withWorkerInterceptors(interceptors []WorkerInterceptor) *activityTaskHandlerImpl {
+	ath.interceptors = interceptors
+	return ath
+}
+
+// Execute executes an implementation of the activity, running it through
+// any registered WorkerInterceptors.
 func (ath *activityTaskHandlerImpl) Execute(ctx context.Context, activityTask *activityTask) (interface{}, error) {
+	activityType := ActivityType{Name: activityTask.task.GetActivityType().GetName()}
+	chain := ath.buildActivityInterceptorChain(activityType)
+	return chain.ExecuteActivity(ctx, activityTask)
+}
+
+// executeCore is the innermost implementation of Execute, invoked as the
+// terminal step of the interceptor chain.
+func (ath *activityTaskHandlerImpl) executeCore(ctx context.Context, activityTask *activityTask) (interface{}, error) {
 	t := activityTask.task
 	ath.logger.Debugf("[WorkflowID: %s] Execute Activity: %s",
 		t.GetWorkflowExecution().GetWorkflowId(), t.GetActivityType().GetName())
 
-	ctx = context.WithValue(ctx, activityEnvContextKey, &activityEnvironment{
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	env := &activityEnvironment{
 		taskToken:    t.TaskToken,
 		identity:     ath.identity,
 		service:      ath.service,
@@ -299,16 +527,54 @@ func (ath *activityTaskHandlerImpl) Execute(ctx context.Context, activityTask *a
 		workflowExecution: WorkflowExecution{
 			RunID: *t.WorkflowExecution.RunId,
 			ID:    *t.WorkflowExecution.WorkflowId},
-	})
+		cancel:            cancel,
+		heartbeatInterval: ath.heartbeatInterval,
+	}
+	ctx = context.WithValue(ctx, activityEnvContextKey, env)
+
 	activityType := *t.GetActivityType()
+	taggedScope := ath.taggedMetricsScope(activityType.GetName())
 	activityImplementation, ok := ath.implementations[flowActivityTypeFrom(activityType)]
 	if !ok {
 		// Couldn't find the activity implementation.
 		return nil, fmt.Errorf("No implementation for activityType=%v", activityType)
 	}
 
-	output, err := activityImplementation.Execute(ctx, t.GetInput())
+	endToEndStart := time.Now()
+	stopHeartbeat := startHeartbeatIfNeeded(ctx, env)
+	executionStart := time.Now()
+	output, err := ath.executeSafely(ctx, activityImplementation, t.GetInput(), taggedScope)
+	if taggedScope != nil {
+		taggedScope.Timer(metrics.ActivityExecutionLatency).Record(time.Now().Sub(executionStart))
+		taggedScope.Timer(metrics.ActivityEndToEndLatency).Record(time.Now().Sub(endToEndStart))
+	}
+	stopHeartbeat()
+
+	canceledErr, isCanceledErr := err.(*CanceledError)
+	if ctx.Err() == context.Canceled || isCanceledErr {
+		env.heartbeatMutex.Lock()
+		lastProgress := env.lastHeartbeatData
+		env.heartbeatMutex.Unlock()
+
+		details := lastProgress
+		if isCanceledErr && canceledErr.Details() != nil {
+			details = canceledErr.Details()
+		}
+
+		if taggedScope != nil {
+			taggedScope.Counter(metrics.ActivityTaskCanceledCounter).Inc(1)
+		}
+		responseCancel := &s.RespondActivityTaskCanceledRequest{
+			TaskToken: t.TaskToken,
+			Details:   details,
+			Identity:  common.StringPtr(ath.identity)}
+		return responseCancel, nil
+	}
+
 	if err != nil {
+		if taggedScope != nil {
+			taggedScope.Counter(metrics.ActivityTaskFailedCounter).Inc(1)
+		}
 		responseFailure := &s.RespondActivityTaskFailedRequest{
 			TaskToken: t.TaskToken,
 			Reason:    common.StringPtr(err.Reason()),
@@ -317,6 +583,9 @@ func (ath *activityTaskHandlerImpl) Execute(ctx context.Context, activityTask *a
 		return responseFailure, nil
 	}
 
+	if taggedScope != nil {
+		taggedScope.Counter(metrics.ActivityTaskCompletedCounter).Inc(1)
+	}
 	responseComplete := &s.RespondActivityTaskCompletedRequest{
 		TaskToken: t.TaskToken,
 		Result_:   output,
@@ -0,0 +1,140 @@
+package cadence
+
+// All code in this file is private to the package.
+
+import (
+	"container/list"
+	"sync"
+
+	"code.uber.internal/devexp/minions-client-go.git/common/metrics"
+	"github.com/uber-go/tally"
+)
+
+// defaultStickyCacheSize is the default number of workflow executions whose
+// event handler is kept warm across decision tasks when sticky execution is
+// enabled.
+const defaultStickyCacheSize = 10000
+
+type (
+	// workflowExecutionCache caches a constructed workflowExecutionEventHandler
+	// per RunID so that a sticky decision task carrying only new events can
+	// resume the cached handler instead of replaying full history.
+	workflowExecutionCache interface {
+		// Get returns the cached handler for runID, if any.
+		Get(runID string) (workflowExecutionEventHandler, bool)
+		// Put inserts or updates the cached handler for runID, evicting the
+		// least recently used entry if the cache is full.
+		Put(runID string, handler workflowExecutionEventHandler)
+		// Evict removes and closes the cached handler for runID, if present.
+		Evict(runID string)
+		// Size returns the number of entries currently cached.
+		Size() int
+	}
+
+	// lruWorkflowCache is a size-bounded, concurrency-safe LRU implementation
+	// of workflowExecutionCache.
+	lruWorkflowCache struct {
+		mutex        sync.Mutex
+		maxSize      int
+		evictList    *list.List
+		entries      map[string]*list.Element
+		metricsScope tally.Scope
+	}
+
+	// cacheEntry is the value stored in the LRU's evictList.
+	cacheEntry struct {
+		runID   string
+		handler workflowExecutionEventHandler
+	}
+)
+
+// newLRUWorkflowCache returns an LRU-bounded workflowExecutionCache. A
+// maxSize of 0 or less falls back to defaultStickyCacheSize.
+func newLRUWorkflowCache(maxSize int, metricsScope tally.Scope) *lruWorkflowCache {
+	if maxSize <= 0 {
+		maxSize = defaultStickyCacheSize
+	}
+	return &lruWorkflowCache{
+		maxSize:      maxSize,
+		evictList:    list.New(),
+		entries:      make(map[string]*list.Element),
+		metricsScope: metricsScope,
+	}
+}
+
+// Get returns the cached handler for runID, promoting it to most-recently
+// used on a hit.
+func (c *lruWorkflowCache) Get(runID string) (workflowExecutionEventHandler, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	element, ok := c.entries[runID]
+	if !ok {
+		c.emitCounter(metrics.StickyCacheMissCounter)
+		return nil, false
+	}
+	c.evictList.MoveToFront(element)
+	c.emitCounter(metrics.StickyCacheHitCounter)
+	return element.Value.(*cacheEntry).handler, true
+}
+
+// Put inserts or refreshes the cached handler for runID, evicting the least
+// recently used entry (and closing its handler) if the cache is full.
+func (c *lruWorkflowCache) Put(runID string, handler workflowExecutionEventHandler) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if element, ok := c.entries[runID]; ok {
+		c.evictList.MoveToFront(element)
+		element.Value.(*cacheEntry).handler = handler
+		return
+	}
+
+	element := c.evictList.PushFront(&cacheEntry{runID: runID, handler: handler})
+	c.entries[runID] = element
+
+	if c.evictList.Len() > c.maxSize {
+		c.evictOldestLocked()
+	}
+}
+
+// Evict removes and closes the cached handler for runID, if present.
+func (c *lruWorkflowCache) Evict(runID string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	element, ok := c.entries[runID]
+	if !ok {
+		return
+	}
+	c.removeElementLocked(element)
+}
+
+// Size returns the number of entries currently cached.
+func (c *lruWorkflowCache) Size() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.evictList.Len()
+}
+
+func (c *lruWorkflowCache) evictOldestLocked() {
+	element := c.evictList.Back()
+	if element == nil {
+		return
+	}
+	c.removeElementLocked(element)
+	c.emitCounter(metrics.StickyCacheEvictCounter)
+}
+
+func (c *lruWorkflowCache) removeElementLocked(element *list.Element) {
+	entry := element.Value.(*cacheEntry)
+	c.evictList.Remove(element)
+	delete(c.entries, entry.runID)
+	entry.handler.Close()
+}
+
+func (c *lruWorkflowCache) emitCounter(name string) {
+	if c.metricsScope != nil {
+		c.metricsScope.Counter(name).Inc(1)
+	}
+}